@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"os"
+	"strings"
+)
+
+// blockSize is the fixed chunk size used for block-level delta transfer,
+// matching Syncthing's default.
+const blockSize = 128 * 1024
+
+// BlockInfo is the weak+strong hash pair identifying a single block of a
+// remote file.
+type BlockInfo struct {
+	Weak   uint32
+	Strong [sha256.Size]byte
+}
+
+// weakHash is a rolling, Adler-32-style checksum over a sliding window so
+// the scanning side can slide byte-by-byte instead of rehashing the whole
+// window on every step.
+type weakHash struct {
+	s1, s2, n uint32
+}
+
+func newWeakHash(block []byte) *weakHash {
+	w := &weakHash{n: uint32(len(block))}
+	for _, b := range block {
+		w.s1 += uint32(b)
+		w.s2 += w.s1
+	}
+	return w
+}
+
+func (w *weakHash) Sum() uint32 {
+	return w.s1<<16 | (w.s2 & 0xffff)
+}
+
+// Roll advances the window by one byte: out leaves, in enters.
+func (w *weakHash) Roll(out, in byte) {
+	w.s1 += uint32(in) - uint32(out)
+	w.s2 += w.s1 - w.n*uint32(out)
+}
+
+// blockSignatures splits r into blockSize chunks and returns the
+// weak+strong hash of each one, in order.
+func blockSignatures(r io.Reader) ([]BlockInfo, error) {
+	var sigs []BlockInfo
+	buf := make([]byte, blockSize)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			block := buf[:n]
+			sigs = append(sigs, BlockInfo{
+				Weak:   newWeakHash(block).Sum(),
+				Strong: sha256.Sum256(block),
+			})
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sigs, nil
+}
+
+// remoteBlockSignatures reads path over the shared SFTP connection and
+// returns its block signatures, or nil if the remote file does not exist
+// yet (in which case the whole file is sent as literal data).
+func remoteBlockSignatures(ctx context.Context, t Transport, path string) ([]BlockInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	sc := t.SFTP()
+	defer t.Release(sc)
+
+	f, err := sc.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	return blockSignatures(f)
+}
+
+type frameType byte
+
+const (
+	frameCopy frameType = iota
+	frameData
+)
+
+// frame is one instruction in the delta wire format applied by the remote
+// receiver: either "copy length bytes from the existing remote file at
+// offset" or "here are length literal bytes to append".
+type frame struct {
+	typ    frameType
+	offset int64
+	length int64
+	data   []byte
+}
+
+func writeFrame(w io.Writer, f frame) error {
+	if err := binary.Write(w, binary.BigEndian, f.typ); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, f.offset); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.BigEndian, f.length); err != nil {
+		return err
+	}
+	if f.typ == frameData {
+		_, err := w.Write(f.data)
+		return err
+	}
+	return nil
+}
+
+// buildDelta compares local against remoteBlocks and produces the minimal
+// set of COPY/DATA frames that reconstruct local on the remote side.
+func buildDelta(local []byte, remoteBlocks []BlockInfo) []frame {
+	if len(local) == 0 {
+		return nil
+	}
+
+	byWeak := make(map[uint32][]int, len(remoteBlocks))
+	for i, b := range remoteBlocks {
+		byWeak[b.Weak] = append(byWeak[b.Weak], i)
+	}
+
+	var frames []frame
+	var literal []byte
+
+	flushLiteral := func() {
+		if len(literal) == 0 {
+			return
+		}
+		frames = append(frames, frame{typ: frameData, length: int64(len(literal)), data: literal})
+		literal = nil
+	}
+
+	pos := 0
+	windowEnd := blockSize
+	if windowEnd > len(local) {
+		windowEnd = len(local)
+	}
+	wh := newWeakHash(local[pos:windowEnd])
+
+	for pos < len(local) {
+		end := pos + blockSize
+		if end > len(local) {
+			end = len(local)
+		}
+		window := local[pos:end]
+
+		if len(window) == blockSize {
+			if candidates, ok := byWeak[wh.Sum()]; ok {
+				strong := sha256.Sum256(window)
+				matched := -1
+				for _, idx := range candidates {
+					if remoteBlocks[idx].Strong == strong {
+						matched = idx
+						break
+					}
+				}
+				if matched >= 0 {
+					flushLiteral()
+					frames = append(frames, frame{
+						typ:    frameCopy,
+						offset: int64(matched) * blockSize,
+						length: int64(len(window)),
+					})
+					pos += blockSize
+					if pos >= len(local) {
+						break
+					}
+					next := pos + blockSize
+					if next > len(local) {
+						next = len(local)
+					}
+					wh = newWeakHash(local[pos:next])
+					continue
+				}
+			}
+		}
+
+		literal = append(literal, local[pos])
+		if pos+blockSize < len(local) {
+			wh.Roll(local[pos], local[pos+blockSize])
+		}
+		pos++
+	}
+	flushLiteral()
+
+	return frames
+}
+
+// remoteReceiverPath is where the receiver script is installed on the
+// remote host. It is relative to the SFTP/SSH login directory (the
+// user's home), so no write access outside of it is required.
+const remoteReceiverPath = ".ssh-sync-receiver.sh"
+
+// receiverScript reconstructs a file from a stream of COPY/DATA frames
+// read from stdin, using dd to splice ranges of the previous version of
+// the file together with freshly streamed literal bytes.
+const receiverScript = `#!/bin/sh
+set -e
+dst="$1"
+old="$dst"
+tmp="$dst.ssh-sync-tmp"
+: > "$tmp"
+while true; do
+  type=$(dd bs=1 count=1 2>/dev/null | od -An -tu1 | tr -d ' ')
+  [ -z "$type" ] && break
+  offset=$(dd bs=8 count=1 2>/dev/null | od -An -tu8 --endian=big | tr -d ' ')
+  length=$(dd bs=8 count=1 2>/dev/null | od -An -tu8 --endian=big | tr -d ' ')
+  have=$(wc -c < "$tmp")
+  if [ "$type" -eq 0 ]; then
+    dd if="$old" of="$tmp" bs=65536 skip="$offset" seek="$have" count="$length" iflag=skip_bytes,count_bytes oflag=seek_bytes conv=notrunc 2>/dev/null
+  else
+    dd of="$tmp" bs=65536 count="$length" seek="$have" iflag=count_bytes oflag=seek_bytes conv=notrunc 2>/dev/null
+  fi
+done
+mv "$tmp" "$dst"
+`
+
+// ensureRemoteReceiver uploads the receiver script over SFTP, overwriting
+// any copy already on the remote host, and makes it executable.
+func ensureRemoteReceiver(ctx context.Context, t Transport) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sc := t.SFTP()
+	defer t.Release(sc)
+
+	f, err := sc.OpenFile(remoteReceiverPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte(receiverScript)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return sc.Chmod(remoteReceiverPath, 0o755)
+}
+
+// splitRemote splits an scp-style "host:path" destination into its host
+// and path parts.
+func splitRemote(dst string) (host, path string, ok bool) {
+	idx := strings.Index(dst, ":")
+	if idx < 0 {
+		return "", "", false
+	}
+	return dst[:idx], dst[idx+1:], true
+}
+
+// deltaTransfer reconstructs path on the remote host from src using
+// block-level COPY/DATA frames sent over a session on the shared SSH
+// connection, instead of re-uploading the whole file every tick. This
+// lets large append-mostly files only send the bytes that changed.
+func deltaTransfer(ctx context.Context, t Transport, src, path string) error {
+	local, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	remoteBlocks, err := remoteBlockSignatures(ctx, t, path)
+	if err != nil {
+		return err
+	}
+
+	if err := ensureRemoteReceiver(ctx, t); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		w := bufio.NewWriter(pw)
+		for _, f := range buildDelta(local, remoteBlocks) {
+			if err := writeFrame(w, f); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if err := w.Flush(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.Close()
+	}()
+
+	cmd := "./" + remoteReceiverPath + " " + shellQuote(path)
+	return runCommandWithInput(ctx, t, cmd, pr)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"lukechampine.com/blake3"
+)
+
+// Hasher computes a content hash, used to detect in-place edits that
+// don't change a file's size (config files, fixed-width-record
+// databases, in-place video re-encodes).
+type Hasher interface {
+	// Name is also the remote command that computes the same hash, so
+	// negotiateHasher can check the remote host supports it.
+	Name() string
+	Sum(r io.Reader) (string, error)
+}
+
+type blake3Hasher struct{}
+
+func (blake3Hasher) Name() string { return "b3sum" }
+
+func (blake3Hasher) Sum(r io.Reader) (string, error) {
+	h := blake3.New(32, nil)
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Name() string { return "sha256sum" }
+
+func (sha256Hasher) Sum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// negotiateHasher picks the fastest hash the remote host also supports,
+// preferring BLAKE3 and falling back to the universally-available
+// SHA-256, similar to rclone's CheckHashes/hash.Type negotiation.
+func negotiateHasher(ctx context.Context, t Transport) Hasher {
+	for _, h := range []Hasher{blake3Hasher{}, sha256Hasher{}} {
+		if _, err := runCommand(ctx, t, "command -v "+h.Name()); err == nil {
+			return h
+		}
+	}
+	return sha256Hasher{}
+}
+
+// hashFile hashes the local file at path with h.
+func hashFile(h Hasher, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return h.Sum(f)
+}
+
+// remoteHash runs h's remote command against path and returns the
+// resulting digest.
+func remoteHash(ctx context.Context, t Transport, h Hasher, path string) (string, error) {
+	out, err := runCommand(ctx, t, h.Name()+" -- "+shellQuote(path))
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("remoteHash: unexpected output %q", out)
+	}
+	return fields[0], nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestHashFileMatchesHasherSum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	if err := os.WriteFile(path, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, h := range []Hasher{blake3Hasher{}, sha256Hasher{}} {
+		want, err := h.Sum(bytes.NewReader(content))
+		if err != nil {
+			t.Fatalf("%s: Sum: %v", h.Name(), err)
+		}
+		got, err := hashFile(h, path)
+		if err != nil {
+			t.Fatalf("%s: hashFile: %v", h.Name(), err)
+		}
+		if got != want {
+			t.Errorf("%s: hashFile = %q, want %q", h.Name(), got, want)
+		}
+	}
+}
+
+func TestHashFileDetectsContentChange(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.txt")
+	h := sha256Hasher{}
+
+	if err := os.WriteFile(path, []byte("version one"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	first, err := hashFile(h, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(path, []byte("version two"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	second, err := hashFile(h, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first == second {
+		t.Error("expected different content to produce different hashes")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gobwas/glob"
+)
+
+// ignoreRule is one compiled line of a .ssh-sync-ignore file.
+type ignoreRule struct {
+	negate  bool
+	dirOnly bool
+	matcher glob.Glob
+}
+
+// IgnoreMatcher holds an ordered list of compiled ignore rules and a
+// per-path cache, so excluded paths never enter the FileStatusTable and
+// the per-tick walk stays cheap. Anchored patterns are rooted at root,
+// so Match expects the absolute paths produced by walking root.
+type IgnoreMatcher struct {
+	mu    sync.Mutex
+	root  string
+	rules []ignoreRule
+	cache map[string]bool
+}
+
+// NewIgnoreMatcher returns an IgnoreMatcher with no rules loaded. root is
+// the sync source directory that anchored patterns (a leading or
+// interior "/") are matched relative to.
+func NewIgnoreMatcher(root string) *IgnoreMatcher {
+	return &IgnoreMatcher{root: root, cache: make(map[string]bool)}
+}
+
+// LoadFile reads a .ssh-sync-ignore file and compiles each of its
+// patterns, appending them to m in file order. Later rules override
+// earlier ones when evaluated by Match.
+func (m *IgnoreMatcher) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if err := m.AddPattern(scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// AddPattern compiles a single gitignore-style pattern and appends it to
+// m. Blank lines and "#" comments are ignored.
+func (m *IgnoreMatcher) AddPattern(pattern string) error {
+	pattern = strings.TrimRight(pattern, "\r\n")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil
+	}
+
+	rule := ignoreRule{}
+
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	// gitignore anchors a pattern to the ignore file's directory whenever
+	// it contains a slash anywhere but the end (already trimmed above),
+	// not just a leading one. Match prefixes every path with "/", so an
+	// unanchored "**/" pattern also matches entries directly under root.
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if anchored {
+		pattern = "/" + pattern
+	} else {
+		pattern = "**/" + pattern
+	}
+
+	g, err := glob.Compile(pattern, '/')
+	if err != nil {
+		return err
+	}
+	rule.matcher = g
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rules = append(m.rules, rule)
+	m.cache = make(map[string]bool)
+	return nil
+}
+
+// Match reports whether path should be excluded from syncing. path is
+// resolved relative to m.root before matching, so anchored patterns
+// (e.g. "/node_modules") line up with the root they were declared
+// against rather than the absolute walked path. Rules are evaluated in
+// order, so a later rule (e.g. a "!" negation) overrides an earlier
+// match.
+func (m *IgnoreMatcher) Match(path string, isDir bool) bool {
+	if m == nil {
+		return false
+	}
+
+	relPath := path
+	if m.root != "" {
+		if rel, err := filepath.Rel(m.root, path); err == nil {
+			relPath = rel
+		}
+	}
+	slashPath := filepathToSlash(relPath)
+	matchPath := "/" + strings.TrimPrefix(slashPath, "/")
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if ignored, ok := m.cache[slashPath]; ok {
+		return ignored
+	}
+
+	ignored := false
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.matcher.Match(matchPath) {
+			ignored = !rule.negate
+		}
+	}
+
+	m.cache[slashPath] = ignored
+	return ignored
+}
+
+func filepathToSlash(path string) string {
+	return strings.ReplaceAll(path, "\\", "/")
+}
+
+// stringList collects repeated occurrences of a CLI flag, such as
+// repeatable -ignore <pattern>.
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestIgnoreMatcherMatch(t *testing.T) {
+	root := filepath.FromSlash("/home/user/project")
+
+	cases := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{
+			name:     "leading slash anchors to root",
+			patterns: []string{"/node_modules"},
+			path:     filepath.Join(root, "node_modules"),
+			isDir:    true,
+			want:     true,
+		},
+		{
+			name:     "anchored pattern does not match nested occurrence",
+			patterns: []string{"/node_modules"},
+			path:     filepath.Join(root, "vendor", "node_modules"),
+			isDir:    true,
+			want:     false,
+		},
+		{
+			name:     "interior slash anchors to root",
+			patterns: []string{"build/output.log"},
+			path:     filepath.Join(root, "build", "output.log"),
+			isDir:    false,
+			want:     true,
+		},
+		{
+			name:     "interior slash pattern does not match at other depths",
+			patterns: []string{"build/output.log"},
+			path:     filepath.Join(root, "sub", "build", "output.log"),
+			isDir:    false,
+			want:     false,
+		},
+		{
+			name:     "unanchored pattern matches at any depth",
+			patterns: []string{"*.log"},
+			path:     filepath.Join(root, "sub", "dir", "debug.log"),
+			isDir:    false,
+			want:     true,
+		},
+		{
+			name:     "negation overrides an earlier match",
+			patterns: []string{"*.log", "!keep.log"},
+			path:     filepath.Join(root, "keep.log"),
+			isDir:    false,
+			want:     false,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := NewIgnoreMatcher(root)
+			for _, p := range c.patterns {
+				if err := m.AddPattern(p); err != nil {
+					t.Fatalf("AddPattern(%q): %v", p, err)
+				}
+			}
+			if got := m.Match(c.path, c.isDir); got != c.want {
+				t.Errorf("Match(%q) = %v, want %v", c.path, got, c.want)
+			}
+		})
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
-	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 )
 
@@ -23,64 +26,152 @@ func debug(format string, args ...interface{}) {
 }
 
 func main() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
 	args := ParseArgs()
 
-	transfer := NewTransfer(args)
-	transfer.Start()
+	transfer := NewTransfer(ctx, args)
+	defer transfer.transport.Close()
+	transfer.Start(ctx)
 }
 
 type Transfer struct {
 	sync.Mutex
 
 	src            string
-	dst            string
+	remoteRoot     string
 	checkDuration  int
 	ignoreExisting bool
 	count          int
+	versioner      string
+	parallel       int
 
-	table FileStatusTable
+	table     FileStatusTable
+	ignore    *IgnoreMatcher
+	transport Transport
+	hasher    Hasher
 }
 
-func NewTransfer(args Args) *Transfer {
+func NewTransfer(ctx context.Context, args Args) *Transfer {
+	ignore := NewIgnoreMatcher(args.src)
+	if args.ignoreFile != "" {
+		if err := ignore.LoadFile(args.ignoreFile); err != nil {
+			debug("error: %v\n", err)
+		}
+	} else if err := ignore.LoadFile(filepath.Join(args.src, ".ssh-sync-ignore")); err != nil {
+		debug("error: %v\n", err)
+	}
+	for _, pattern := range args.ignorePatterns {
+		if err := ignore.AddPattern(pattern); err != nil {
+			debug("error: %v\n", err)
+		}
+	}
+
+	host, remoteRoot, ok := splitRemote(args.dst)
+	if !ok {
+		debug("error: dst %q must be of the form host:path\n", args.dst)
+		os.Exit(1)
+	}
+
+	parallel := args.parallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	transport, err := NewSSHTransport(ctx, host, parallel)
+	if err != nil {
+		debug("error: %v\n", err)
+		os.Exit(1)
+	}
+
+	hasher := negotiateHasher(ctx, transport)
+	debug("Using %s for content-hash verification\n", hasher.Name())
+
 	return &Transfer{
 		src:            args.src,
-		dst:            args.dst,
+		remoteRoot:     remoteRoot,
 		checkDuration:  args.checkDuration,
 		ignoreExisting: args.ignoreExisting,
 		count:          args.count,
+		versioner:      args.versioner,
+		parallel:       parallel,
 		table:          make(FileStatusTable),
+		ignore:         ignore,
+		transport:      transport,
+		hasher:         hasher,
 	}
 }
 
-func (t *Transfer) Start() {
-	t.InitExisting()
+// Start runs the sync loop until ctx is cancelled. On cancellation it
+// stops feeding new tasks, waits for in-flight transfers to finish, and
+// resets any task that was still Transferring back to Idle so a restart
+// picks it up again.
+func (t *Transfer) Start(ctx context.Context) {
+	t.InitExisting(ctx)
 	if !t.ignoreExisting {
-		t.Transfer(Task{src: t.src, dst: t.dst})
+		t.Transfer(ctx, Task{src: t.src, dst: t.remoteRoot})
 	}
 
 	taskChan := make(chan Task)
+	var workers sync.WaitGroup
+
+	for i := 0; i < t.parallel; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for task := range taskChan {
+				t.Transfer(ctx, task)
+			}
+		}()
+	}
 
-	go func() {
+loop:
+	for {
+		t.UpdateFileStatus(ctx)
+
+		targets := t.ScanTargets(ctx)
+	drain:
 		for {
-			task := <-taskChan
-			t.Transfer(task)
+			select {
+			case target, ok := <-targets:
+				if !ok {
+					break drain
+				}
+				select {
+				case taskChan <- Task{
+					src:    target.path,
+					dst:    filepath.Join(t.remoteRoot, target.path),
+					delete: target.status == PendingDelete,
+				}:
+				case <-ctx.Done():
+					break drain
+				}
+			case <-ctx.Done():
+				break drain
+			}
 		}
-	}()
 
-	for {
-		t.UpdateFileStatus()
-		for target := range t.ScanTargets() {
-			taskChan <- Task{
-				src: target.path,
-				dst: filepath.Join(t.dst, target.path),
-			}
+		select {
+		case <-ctx.Done():
+			break loop
+		case <-time.After(time.Duration(t.checkDuration) * time.Second):
 		}
+	}
 
-		time.Sleep(time.Duration(t.checkDuration) * time.Second)
+	close(taskChan)
+	workers.Wait()
+
+	t.Lock()
+	defer t.Unlock()
+	for path, fs := range t.table {
+		if fs.status == Transferring {
+			t.table.SetStatus(path, Idle)
+		}
 	}
 }
 
-func (t *Transfer) InitExisting() {
+func (t *Transfer) InitExisting(ctx context.Context) {
 	t.Lock()
 	defer t.Unlock()
 
@@ -90,15 +181,31 @@ func (t *Transfer) InitExisting() {
 			if err != nil {
 				return err
 			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			if path != t.src && t.ignore.Match(path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
 
 			var fileType FileType
+			var hash string
 			if info.IsDir() {
 				fileType = Directory
 			} else {
 				fileType = File
+				if h, err := hashFile(t.hasher, path); err != nil {
+					debug("error: %v\n", err)
+				} else {
+					hash = h
+				}
 			}
 
-			t.table.Add(path, fileType, int(info.Size()))
+			t.table.Add(path, fileType, int(info.Size()), info.ModTime(), hash)
 			t.table.SetStatus(path, Complete)
 
 			return nil
@@ -114,36 +221,65 @@ func (t *Transfer) InitExisting() {
 	}
 }
 
-func (t *Transfer) UpdateFileStatus() {
+func (t *Transfer) UpdateFileStatus(ctx context.Context) {
+	seen := map[string]bool{t.src: true}
+
 	err := filepath.Walk(
 		t.src,
 		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
 
 			if path == t.src {
 				return nil
 			}
 
+			if t.ignore.Match(path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
 			t.Lock()
 			defer t.Unlock()
 
+			seen[path] = true
+
 			if info.IsDir() {
 				if !t.table.IsExists(path) {
 					debug("Found new directory: %s\n", path)
-					t.table.AddNewDirectory(path)
+					t.table.AddNewDirectory(path, t.ignore, t.hasher)
 				}
 			} else {
 				fileSize := int(info.Size())
+				modTime := info.ModTime()
 				if !t.table.IsExists(path) {
 					debug("Found new file: %s\n", path)
-					t.table.AddNewFile(path, fileSize)
-				} else if t.table.GetSize(path) != fileSize {
-					debug("Found updated file: %s\n", path)
-					t.table.SetSize(path, fileSize)
-					t.table.SetStatus(path, Idle)
-					t.table.ResetCount(path)
+					hash, err := hashFile(t.hasher, path)
+					if err != nil {
+						debug("error: %v\n", err)
+					}
+					t.table.AddNewFile(path, fileSize, modTime, hash)
+				} else if t.table.GetSize(path) != fileSize || !t.table.GetModTime(path).Equal(modTime) {
+					hash, err := hashFile(t.hasher, path)
+					if err != nil {
+						debug("error: %v\n", err)
+					} else if hash != t.table.GetHash(path) {
+						debug("Found updated file: %s\n", path)
+						t.table.SetSize(path, fileSize)
+						t.table.SetModTime(path, modTime)
+						t.table.SetHash(path, hash)
+						t.table.SetStatus(path, Idle)
+						t.table.ResetCount(path)
+					} else {
+						t.table.SetSize(path, fileSize)
+						t.table.SetModTime(path, modTime)
+					}
 				}
 			}
 
@@ -154,40 +290,103 @@ func (t *Transfer) UpdateFileStatus() {
 		if os.IsNotExist(err) {
 			debug("error: %s does not exist\n", t.src)
 			os.Exit(1)
-		} else {
+		} else if ctx.Err() == nil {
 			debug("error: %v\n", err)
 		}
 	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for path, fs := range t.table {
+		if seen[path] || fs.status == PendingDelete {
+			continue
+		}
+		debug("Found deleted path: %s\n", path)
+		t.table.SetStatus(path, PendingDelete)
+	}
 }
 
-func (t *Transfer) ScanTargets() <-chan FileStatus {
+func (t *Transfer) ScanTargets(ctx context.Context) <-chan FileStatus {
 	targetChan := make(chan FileStatus)
 
 	t.Lock()
-	table := t.table
+	table := make(FileStatusTable, len(t.table))
+	for path, fs := range t.table {
+		table[path] = fs
+	}
 	t.Unlock()
 
+	send := func(fs FileStatus) bool {
+		select {
+		case targetChan <- fs:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	pendingDeleteDirs := make([]string, 0)
+	for path, fs := range table {
+		if fs.status == PendingDelete && fs.fileType == Directory {
+			pendingDeleteDirs = append(pendingDeleteDirs, path)
+		}
+	}
+
 	go func() {
 		for path, fs := range table {
+			if ctx.Err() != nil {
+				break
+			}
+
+			if fs.status == PendingDelete {
+				// A directory delete removes everything beneath it, so
+				// queuing a child's own delete concurrently races with
+				// the parent's rm/mv; let the parent's delete clean up
+				// its descendants instead (see Transfer).
+				if hasPendingDeleteAncestor(path, pendingDeleteDirs) {
+					continue
+				}
+
+				t.Lock()
+				t.table.SetStatus(path, Transferring)
+				t.Unlock()
+				if !send(fs) {
+					break
+				}
+				continue
+			}
+
 			if fs.status != Idle {
 				continue
 			}
+			if t.ignore.Match(path, fs.fileType == Directory) {
+				continue
+			}
 
 			t.Lock()
 			if fs.fileType == Directory {
 				t.table.SetStatus(path, Transferring)
-				targetChan <- fs
+				t.Unlock()
+				if !send(fs) {
+					break
+				}
 			} else {
 				count := t.table.GetCount(path)
 				if count >= t.count {
 					t.table.ResetCount(path)
 					t.table.SetStatus(path, Transferring)
-					targetChan <- fs
+					t.Unlock()
+					if !send(fs) {
+						break
+					}
 				} else {
 					t.table.IncrementCount(path)
+					t.Unlock()
 				}
 			}
-			t.Unlock()
 		}
 
 		close(targetChan)
@@ -196,11 +395,81 @@ func (t *Transfer) ScanTargets() <-chan FileStatus {
 	return targetChan
 }
 
-func (t *Transfer) Transfer(task Task) {
+// hasPendingDeleteAncestor reports whether path is nested under any of
+// dirs, used to hold off queuing a child's own delete while its parent
+// directory is also about to be deleted.
+func hasPendingDeleteAncestor(path string, dirs []string) bool {
+	for _, dir := range dirs {
+		if isPathUnder(path, dir) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPathUnder reports whether path is a strict descendant of dir.
+func isPathUnder(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+func (t *Transfer) Transfer(ctx context.Context, task Task) {
+	if task.delete {
+		debug("Delete: %s\n", task.dst)
+
+		if err := remoteDelete(ctx, t.transport, t.remoteRoot, task.dst, t.versioner); err != nil {
+			debug("error: %v\n", err)
+			t.Lock()
+			defer t.Unlock()
+			if t.table.IsExists(task.src) {
+				t.table.SetStatus(task.src, PendingDelete)
+			}
+			return
+		}
+
+		t.Lock()
+		defer t.Unlock()
+		t.table.Remove(task.src)
+		for path := range t.table {
+			if isPathUnder(path, task.src) {
+				t.table.Remove(path)
+			}
+		}
+		return
+	}
+
 	debug("Transfer: %s -> %s\n", task.src, task.dst)
 
-	cmd := exec.Command("scp", "-r", task.src, task.dst)
-	if err := cmd.Run(); err != nil {
+	t.Lock()
+	fs := t.table.Get(task.src)
+	t.Unlock()
+
+	var err error
+	if fs.fileType == Directory {
+		err = t.syncDirectory(ctx, task.src, task.dst)
+	} else {
+		err = deltaTransfer(ctx, t.transport, task.src, task.dst)
+		if err == nil {
+			remoteSum, herr := remoteHash(ctx, t.transport, t.hasher, task.dst)
+			if herr != nil || remoteSum != fs.hash {
+				if herr != nil {
+					debug("error: %v\n", herr)
+				} else {
+					debug("Hash mismatch after transfer, re-queueing: %s\n", task.src)
+				}
+				t.Lock()
+				defer t.Unlock()
+				if t.table.IsExists(task.src) && !t.table.IsIdle(task.src) {
+					t.table.SetStatus(task.src, Idle)
+				}
+				return
+			}
+		}
+	}
+	if err != nil {
 		debug("error: %v\n", err)
 	}
 
@@ -212,17 +481,57 @@ func (t *Transfer) Transfer(task Task) {
 	}
 }
 
+// syncDirectory creates dst on the remote host and recursively delta-
+// transfers every non-ignored file under src into it, replacing the old
+// single "scp -r" call now that transfers go through the SFTP/SSH pool.
+func (t *Transfer) syncDirectory(ctx context.Context, src, dst string) error {
+	if err := remoteMkdir(ctx, t.transport, dst); err != nil {
+		return err
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if path == src {
+			return nil
+		}
+		if t.ignore.Match(path, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		remotePath := filepath.Join(dst, rel)
+
+		if info.IsDir() {
+			return remoteMkdir(ctx, t.transport, remotePath)
+		}
+		return deltaTransfer(ctx, t.transport, path, remotePath)
+	})
+}
+
 type Task struct {
-	src string
-	dst string
+	src    string
+	dst    string
+	delete bool
 }
 
 type FileTransferStatus string
 
 const (
-	Idle         FileTransferStatus = "idle"
-	Transferring FileTransferStatus = "transferring"
-	Complete     FileTransferStatus = "complete"
+	Idle          FileTransferStatus = "idle"
+	Transferring  FileTransferStatus = "transferring"
+	Complete      FileTransferStatus = "complete"
+	PendingDelete FileTransferStatus = "pending_delete"
 )
 
 type FileType string
@@ -238,26 +547,34 @@ type FileStatus struct {
 	fileType   FileType
 	size       int
 	checkCount int
+	modTime    time.Time
+	hash       string
 }
 
 type FileStatusTable map[string]FileStatus
 
-func (t *FileStatusTable) Add(path string, fileType FileType, size int) {
+func (t *FileStatusTable) Add(path string, fileType FileType, size int, modTime time.Time, hash string) {
 	(*t)[path] = FileStatus{
 		path:       path,
 		status:     Idle,
 		fileType:   fileType,
 		size:       size,
 		checkCount: 0,
+		modTime:    modTime,
+		hash:       hash,
 	}
 }
 
-func (t *FileStatusTable) AddNewFile(path string, size int) {
-	t.Add(path, File, size)
+func (t *FileStatusTable) AddNewFile(path string, size int, modTime time.Time, hash string) {
+	t.Add(path, File, size, modTime, hash)
 }
 
-func (t *FileStatusTable) AddNewDirectory(root string) {
-	t.Add(root, Directory, directorySize)
+// AddNewDirectory registers root as Idle, so it is queued for transfer,
+// and everything under it as already transferred (Complete), since
+// transferring root syncs its contents. Each file is hashed with hasher
+// so later content-hash comparisons have a baseline to compare against.
+func (t *FileStatusTable) AddNewDirectory(root string, ignore *IgnoreMatcher, hasher Hasher) {
+	t.Add(root, Directory, directorySize, time.Time{}, "")
 
 	err := filepath.Walk(
 		root,
@@ -270,10 +587,21 @@ func (t *FileStatusTable) AddNewDirectory(root string) {
 				return nil
 			}
 
+			if ignore.Match(path, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
 			if info.IsDir() {
-				t.Add(path, Directory, directorySize)
+				t.Add(path, Directory, directorySize, time.Time{}, "")
 			} else {
-				t.Add(path, File, int(info.Size()))
+				hash, err := hashFile(hasher, path)
+				if err != nil {
+					debug("error: %v\n", err)
+				}
+				t.Add(path, File, int(info.Size()), info.ModTime(), hash)
 			}
 			t.SetStatus(path, Complete)
 
@@ -309,6 +637,8 @@ func (t *FileStatusTable) SetStatus(path string, status FileTransferStatus) {
 		fileType:   fs.fileType,
 		size:       fs.size,
 		checkCount: fs.checkCount,
+		modTime:    fs.modTime,
+		hash:       fs.hash,
 	}
 }
 
@@ -325,6 +655,8 @@ func (t *FileStatusTable) SetCount(path string, checkCount int) {
 		fileType:   fs.fileType,
 		size:       fs.size,
 		checkCount: checkCount,
+		modTime:    fs.modTime,
+		hash:       fs.hash,
 	}
 }
 
@@ -340,6 +672,8 @@ func (t *FileStatusTable) IncrementCount(path string) {
 		fileType:   fs.fileType,
 		size:       fs.size,
 		checkCount: fs.checkCount + 1,
+		modTime:    fs.modTime,
+		hash:       fs.hash,
 	}
 }
 
@@ -356,6 +690,44 @@ func (t *FileStatusTable) SetSize(path string, size int) {
 		fileType:   fs.fileType,
 		size:       size,
 		checkCount: fs.checkCount,
+		modTime:    fs.modTime,
+		hash:       fs.hash,
+	}
+}
+
+func (t *FileStatusTable) GetModTime(path string) time.Time {
+	fs := (*t)[path]
+	return fs.modTime
+}
+
+func (t *FileStatusTable) SetModTime(path string, modTime time.Time) {
+	fs := (*t)[path]
+	(*t)[path] = FileStatus{
+		path:       path,
+		status:     fs.status,
+		fileType:   fs.fileType,
+		size:       fs.size,
+		checkCount: fs.checkCount,
+		modTime:    modTime,
+		hash:       fs.hash,
+	}
+}
+
+func (t *FileStatusTable) GetHash(path string) string {
+	fs := (*t)[path]
+	return fs.hash
+}
+
+func (t *FileStatusTable) SetHash(path string, hash string) {
+	fs := (*t)[path]
+	(*t)[path] = FileStatus{
+		path:       path,
+		status:     fs.status,
+		fileType:   fs.fileType,
+		size:       fs.size,
+		checkCount: fs.checkCount,
+		modTime:    fs.modTime,
+		hash:       hash,
 	}
 }
 
@@ -370,6 +742,10 @@ type Args struct {
 	checkDuration  int
 	ignoreExisting bool
 	count          int
+	ignoreFile     string
+	ignorePatterns []string
+	versioner      string
+	parallel       int
 }
 
 func ParseArgs() Args {
@@ -378,6 +754,10 @@ func ParseArgs() Args {
 	var count int
 	var help bool
 	var verbose bool
+	var ignoreFile string
+	var ignorePatterns stringList
+	var versioner string
+	var parallel int
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s [options] <src> <dst>\n", os.Args[0])
@@ -389,6 +769,10 @@ func ParseArgs() Args {
 	flag.IntVar(&count, "count", 0, "Check count. This program transfers files after checking n times. If the file size is updated, the check count is reset. This option is useful for transferring large files that are updated frequently.")
 	flag.BoolVar(&help, "h", false, "Show help.")
 	flag.BoolVar(&verbose, "v", false, "Verbose mode. This program outputs debug messages if this flag is set.")
+	flag.StringVar(&ignoreFile, "ignore-file", "", "Path to a .ssh-sync-ignore file. Defaults to <src>/.ssh-sync-ignore.")
+	flag.Var(&ignorePatterns, "ignore", "Gitignore-style pattern to exclude from syncing. Can be repeated.")
+	flag.StringVar(&versioner, "versioner", "", "How to handle files deleted from src: \"trash\" moves them to <dst>/.ssh-sync-trash, \"simple\" keeps the last few timestamped copies, \"staggered\" keeps one version per age bucket. Defaults to deleting outright.")
+	flag.IntVar(&parallel, "parallel", 4, "Number of concurrent SFTP workers used to transfer files.")
 	flag.Parse()
 
 	args := flag.Args()
@@ -407,5 +791,9 @@ func ParseArgs() Args {
 		checkDuration:  checkDuration,
 		ignoreExisting: ignoreExisting,
 		count:          count,
+		ignoreFile:     ignoreFile,
+		ignorePatterns: ignorePatterns,
+		versioner:      versioner,
+		parallel:       parallel,
 	}
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsPathUnder(t *testing.T) {
+	cases := []struct {
+		path, dir string
+		want      bool
+	}{
+		{"/home/user/project/dir/file.txt", "/home/user/project/dir", true},
+		{"/home/user/project/dir", "/home/user/project/dir", false},
+		{"/home/user/project/other/file.txt", "/home/user/project/dir", false},
+		{"/home/user/project/dir2/file.txt", "/home/user/project/dir", false},
+	}
+
+	for _, c := range cases {
+		if got := isPathUnder(c.path, c.dir); got != c.want {
+			t.Errorf("isPathUnder(%q, %q) = %v, want %v", c.path, c.dir, got, c.want)
+		}
+	}
+}
+
+func TestHasPendingDeleteAncestor(t *testing.T) {
+	dirs := []string{"/home/user/project/dir"}
+
+	if !hasPendingDeleteAncestor("/home/user/project/dir/child/file.txt", dirs) {
+		t.Error("expected a descendant of a pending-delete dir to be reported")
+	}
+	if hasPendingDeleteAncestor("/home/user/project/other/file.txt", dirs) {
+		t.Error("did not expect an unrelated path to be reported")
+	}
+}
+
+// TestScanTargetsConcurrentWithWorkers simulates the real access pattern:
+// ScanTargets ranges the table while worker goroutines concurrently call
+// SetStatus on it, as Transfer does once a task is dispatched. Run
+// with -race; it must not report a data race or trip Go's fatal
+// concurrent-map-iteration-and-write detector.
+func TestScanTargetsConcurrentWithWorkers(t *testing.T) {
+	tr := &Transfer{
+		ignore: NewIgnoreMatcher(""),
+		count:  1,
+	}
+	tr.table = make(FileStatusTable)
+	paths := make([]string, 1000)
+	for i := range paths {
+		path := fmt.Sprintf("/src/file%d", i)
+		paths[i] = path
+		tr.table.Add(path, File, 1, time.Time{}, "h")
+		tr.table.SetStatus(path, Idle)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Hammer the live table with writes for the duration of the scan,
+	// mirroring worker goroutines racing Transfer's SetStatus calls
+	// against ScanTargets' read of the same table.
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		writers.Add(1)
+		go func(i int) {
+			defer writers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					tr.Lock()
+					tr.table.SetStatus(paths[i], Complete)
+					tr.Unlock()
+				}
+			}
+		}(i)
+	}
+
+	targets := tr.ScanTargets(ctx)
+	for range targets {
+	}
+
+	close(stop)
+	writers.Wait()
+}
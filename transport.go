@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/kevinburke/ssh_config"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Transport is how Transfer talks to the remote host. SSHTransport is the
+// only implementation; the interface exists so the worker pool in Start
+// doesn't need to know how a command or file write actually reaches the
+// remote side.
+type Transport interface {
+	// Session opens a new, cheap multiplexed session on the shared SSH
+	// connection for running a single remote command.
+	Session() (*ssh.Session, error)
+	// SFTP borrows an *sftp.Client from the worker pool; the caller must
+	// return it with Release when done.
+	SFTP() *sftp.Client
+	Release(c *sftp.Client)
+	Close() error
+}
+
+// SSHTransport holds one multiplexed *ssh.Client plus a pool of
+// *sftp.Client workers, so transferring N files in parallel costs zero
+// extra process forks or authentication handshakes.
+type SSHTransport struct {
+	client *ssh.Client
+	pool   chan *sftp.Client
+}
+
+// NewSSHTransport dials host (resolved through ~/.ssh/config, including
+// ProxyJump bastions), authenticating via ssh-agent, and pre-warms a pool
+// of parallel SFTP clients sharing that one connection. ctx bounds only
+// the direct TCP dial; SSH handshakes and dials through a ProxyJump
+// bastion are not cancelled by it, and it is not retained afterwards.
+func NewSSHTransport(ctx context.Context, host string, parallel int) (*SSHTransport, error) {
+	client, err := dialSSH(ctx, host, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := make(chan *sftp.Client, parallel)
+	for i := 0; i < parallel; i++ {
+		sc, err := sftp.NewClient(client)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("sftp client %d: %w", i, err)
+		}
+		pool <- sc
+	}
+
+	return &SSHTransport{client: client, pool: pool}, nil
+}
+
+func (t *SSHTransport) Session() (*ssh.Session, error) {
+	return t.client.NewSession()
+}
+
+func (t *SSHTransport) SFTP() *sftp.Client {
+	return <-t.pool
+}
+
+func (t *SSHTransport) Release(c *sftp.Client) {
+	t.pool <- c
+}
+
+func (t *SSHTransport) Close() error {
+	close(t.pool)
+	for c := range t.pool {
+		c.Close()
+	}
+	return t.client.Close()
+}
+
+// dialSSH resolves host through ~/.ssh/config, following a ProxyJump
+// chain by dialing each bastion in turn over via's connection.
+func dialSSH(ctx context.Context, host string, via *ssh.Client) (*ssh.Client, error) {
+	cfg, err := sshClientConfig(host)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname := ssh_config.Get(host, "HostName")
+	if hostname == "" {
+		hostname = host
+	}
+	port := ssh_config.Get(host, "Port")
+	if port == "" {
+		port = "22"
+	}
+	addr := net.JoinHostPort(hostname, port)
+
+	if via == nil {
+		if jump := ssh_config.Get(host, "ProxyJump"); jump != "" {
+			bastion, err := dialSSH(ctx, jump, nil)
+			if err != nil {
+				return nil, fmt.Errorf("proxyjump %s: %w", jump, err)
+			}
+			return dialOver(bastion, addr, cfg)
+		}
+		return dialDirect(ctx, addr, cfg)
+	}
+
+	return dialOver(via, addr, cfg)
+}
+
+func dialDirect(ctx context.Context, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+func dialOver(via *ssh.Client, addr string, cfg *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := via.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshClientConfig builds an ssh.ClientConfig for host using ssh-agent
+// auth (SSH_AUTH_SOCK) and known_hosts verification.
+func sshClientConfig(host string) (*ssh.ClientConfig, error) {
+	user := ssh_config.Get(host, "User")
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+
+	authSock := os.Getenv("SSH_AUTH_SOCK")
+	if authSock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set; ssh-sync requires a running ssh-agent")
+	}
+	conn, err := net.Dial("unix", authSock)
+	if err != nil {
+		return nil, fmt.Errorf("dial ssh-agent: %w", err)
+	}
+	agentClient := agent.NewClient(conn)
+
+	khPath := filepath.Join(os.Getenv("HOME"), ".ssh", "known_hosts")
+	hostKeyCallback, err := knownhosts.New(khPath)
+	if err != nil {
+		return nil, fmt.Errorf("load known_hosts: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeysCallback(agentClient.Signers)},
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// runCommand runs cmd on the remote host over a fresh multiplexed
+// session and returns its stdout. Cancelling ctx closes the
+// session, aborting the remote command.
+func runCommand(ctx context.Context, t Transport, cmd string) ([]byte, error) {
+	session, err := t.Session()
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+	defer watchContext(ctx, session)()
+
+	return session.Output(cmd)
+}
+
+// runCommandWithInput runs cmd on the remote host, streaming stdin to it.
+// Cancelling ctx closes the session, interrupting an in-flight transfer.
+func runCommandWithInput(ctx context.Context, t Transport, cmd string, stdin io.Reader) error {
+	session, err := t.Session()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	defer watchContext(ctx, session)()
+
+	session.Stdin = stdin
+	return session.Run(cmd)
+}
+
+// watchContext closes session if ctx is cancelled before the returned
+// stop function is called, mirroring exec.CommandContext's cancellation
+// for commands that run over an SSH session rather than a subprocess.
+func watchContext(ctx context.Context, session *ssh.Session) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// remoteMkdir creates path (and any missing parents) on the remote host.
+func remoteMkdir(ctx context.Context, t Transport, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sc := t.SFTP()
+	defer t.Release(sc)
+	return sc.MkdirAll(path)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// simpleVersionsToKeep is how many timestamped copies the "simple"
+// versioner retains before pruning the oldest.
+const simpleVersionsToKeep = 5
+
+// shellQuote wraps s in single quotes so it can be safely embedded in a
+// remote shell command, escaping any single quotes it contains.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remoteDelete removes remotePath from the remote host, routing through
+// the configured versioner so that deletion is never silently
+// destructive.
+func remoteDelete(ctx context.Context, t Transport, dstRoot, remotePath, versioner string) error {
+	switch versioner {
+	case "trash":
+		return remoteTrash(ctx, t, dstRoot, remotePath)
+	case "simple":
+		return remoteSimpleVersion(ctx, t, remotePath)
+	case "staggered":
+		return remoteStaggeredVersion(ctx, t, remotePath)
+	default:
+		_, err := runCommand(ctx, t, fmt.Sprintf("rm -rf -- %s", shellQuote(remotePath)))
+		return err
+	}
+}
+
+// remoteTrash moves the remote file into <dstRoot>/.ssh-sync-trash/<path
+// relative to dstRoot> instead of deleting it.
+func remoteTrash(ctx context.Context, t Transport, dstRoot, remotePath string) error {
+	rel := strings.TrimPrefix(remotePath, dstRoot)
+	rel = strings.TrimPrefix(rel, "/")
+	trashPath := path.Join(dstRoot, ".ssh-sync-trash", rel)
+
+	cmd := fmt.Sprintf(
+		"mkdir -p -- %s && mv -- %s %s",
+		shellQuote(path.Dir(trashPath)),
+		shellQuote(remotePath),
+		shellQuote(trashPath),
+	)
+	_, err := runCommand(ctx, t, cmd)
+	return err
+}
+
+// remoteSimpleVersion renames the remote file with a timestamp suffix and
+// prunes all but the simpleVersionsToKeep most recent copies.
+func remoteSimpleVersion(ctx context.Context, t Transport, remotePath string) error {
+	cmd := fmt.Sprintf(
+		`mv -- %s %s.$(date +%%Y%%m%%d%%H%%M%%S) && `+
+			`ls -1t %s.* 2>/dev/null | tail -n +%d | xargs -r rm -f --`,
+		shellQuote(remotePath), shellQuote(remotePath),
+		shellQuote(remotePath), simpleVersionsToKeep+1,
+	)
+	_, err := runCommand(ctx, t, cmd)
+	return err
+}
+
+// staggeredVersionerPath is where the staggered-versioning helper script
+// is installed on the remote host, relative to the login directory.
+const staggeredVersionerPath = ".ssh-sync-staggered.sh"
+
+// staggeredVersionerScript buckets a deleted file's versions by age (1h,
+// 1d, 1w, 1mo) and prunes anything older than the oldest bucket, so a
+// stream of deletes doesn't grow the remote trash unboundedly.
+const staggeredVersionerScript = `#!/bin/sh
+set -e
+src="$1"
+base="$src.ssh-sync-versions"
+mkdir -p "$base"
+stamp=$(date +%Y-%m-%dT%H:%M:%S)
+mv -- "$src" "$base/$stamp"
+
+now=$(date +%s)
+for f in "$base"/*/* "$base"/*; do
+  [ -f "$f" ] || continue
+  name=$(basename "$f")
+  age=$((now - $(date -d "${name}" +%s 2>/dev/null || echo "$now")))
+  if   [ "$age" -lt 3600 ];    then bucket="1h"
+  elif [ "$age" -lt 86400 ];   then bucket="1d"
+  elif [ "$age" -lt 604800 ];  then bucket="1w"
+  elif [ "$age" -lt 2592000 ]; then bucket="1mo"
+  else rm -f -- "$f"; continue
+  fi
+  [ "$f" = "$base/$bucket/$name" ] && continue
+  mkdir -p "$base/$bucket"
+  keep="$base/$bucket/$(ls -1 "$base/$bucket" 2>/dev/null | tail -1)"
+  if [ -e "$keep" ] && [ "$keep" != "$base/$bucket/" ]; then
+    rm -f -- "$f"
+  else
+    mv -- "$f" "$base/$bucket/$name"
+  fi
+done
+`
+
+// remoteStaggeredVersion uploads the staggered-versioning helper over
+// SFTP, overwriting any existing copy, and runs it against remotePath.
+func remoteStaggeredVersion(ctx context.Context, t Transport, remotePath string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	sc := t.SFTP()
+	f, err := sc.OpenFile(staggeredVersionerPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC)
+	if err != nil {
+		t.Release(sc)
+		return err
+	}
+	if _, err := f.Write([]byte(staggeredVersionerScript)); err != nil {
+		f.Close()
+		t.Release(sc)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		t.Release(sc)
+		return err
+	}
+	err = sc.Chmod(staggeredVersionerPath, 0o755)
+	t.Release(sc)
+	if err != nil {
+		return err
+	}
+
+	_, err = runCommand(ctx, t, "./"+staggeredVersionerPath+" "+shellQuote(remotePath))
+	return err
+}
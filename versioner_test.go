@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStaggeredVersionerBuckets runs the embedded staggeredVersionerScript
+// against a source file and a set of pre-existing version files backdated
+// to different ages, proving stamps round-trip through `date -d` and that
+// versions land in the bucket their age actually corresponds to.
+func TestStaggeredVersionerBuckets(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+
+	dir := t.TempDir()
+	script := filepath.Join(dir, "staggered.sh")
+	if err := os.WriteFile(script, []byte(staggeredVersionerScript), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	src := filepath.Join(dir, "access.log")
+	if err := os.WriteFile(src, []byte("current"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	base := src + ".ssh-sync-versions"
+	if err := os.MkdirAll(base, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	ages := map[string]time.Duration{
+		"old-12h": 12 * time.Hour,
+		"old-3d":  3 * 24 * time.Hour,
+	}
+	for name, age := range ages {
+		stamp := time.Now().Add(-age).Format("2006-01-02T15:04:05")
+		if err := os.WriteFile(filepath.Join(base, stamp), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cmd := exec.Command("sh", script, src)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("script failed: %v\noutput:\n%s", err, out)
+	}
+
+	entries, err := os.ReadDir(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buckets := make(map[string]bool)
+	for _, e := range entries {
+		if e.IsDir() {
+			buckets[e.Name()] = true
+		}
+	}
+
+	for _, want := range []string{"1d", "1w"} {
+		if !buckets[want] {
+			got := make([]string, 0, len(buckets))
+			for b := range buckets {
+				got = append(got, b)
+			}
+			t.Errorf("expected bucket %q to exist, got buckets: %s", want, strings.Join(got, ","))
+		}
+	}
+
+	dayBucket, err := os.ReadDir(filepath.Join(base, "1d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dayBucket) != 1 {
+		t.Errorf("1d bucket: got %d entries, want 1", len(dayBucket))
+	}
+}